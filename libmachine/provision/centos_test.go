@@ -0,0 +1,200 @@
+package provision
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/drivers"
+	"github.com/docker/machine/ssh"
+)
+
+// fakeSSHRecorder fakes runSSHCommand: it records every command it's asked
+// to run and returns a canned response keyed by a substring match, so tests
+// don't need a real driver or SSH connection.
+type fakeSSHRecorder struct {
+	commands  []string
+	responses map[string]string // command substring -> stdout
+	fail      map[string]bool   // command substring -> return an error
+}
+
+func newFakeSSHRecorder() *fakeSSHRecorder {
+	return &fakeSSHRecorder{
+		responses: map[string]string{},
+		fail:      map[string]bool{},
+	}
+}
+
+func (f *fakeSSHRecorder) run(d drivers.Driver, args string) (ssh.Output, error) {
+	f.commands = append(f.commands, args)
+
+	for substr := range f.fail {
+		if strings.Contains(args, substr) {
+			return ssh.Output{Stdout: strings.NewReader("")}, errExit
+		}
+	}
+
+	for substr, out := range f.responses {
+		if strings.Contains(args, substr) {
+			return ssh.Output{Stdout: strings.NewReader(out)}, nil
+		}
+	}
+
+	return ssh.Output{Stdout: strings.NewReader("")}, nil
+}
+
+func (f *fakeSSHRecorder) countContaining(substr string) int {
+	count := 0
+	for _, c := range f.commands {
+		if strings.Contains(c, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+var errExit = &exitError{"command exited non-zero"}
+
+type exitError struct{ msg string }
+
+func (e *exitError) Error() string { return e.msg }
+
+func withFakeSSH(t *testing.T, recorder *fakeSSHRecorder, fn func()) {
+	old := runSSHCommand
+	runSSHCommand = recorder.run
+	defer func() { runSSHCommand = old }()
+	fn()
+}
+
+func TestUpdatesPendingSkipsYumUpdateWhenNothingPending(t *testing.T) {
+	recorder := newFakeSSHRecorder()
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if provisioner.updatesPending() {
+			t.Fatal("expected no updates pending when yum check-update succeeds")
+		}
+	})
+}
+
+func TestUpdatesPendingWhenYumCheckUpdateFails(t *testing.T) {
+	recorder := newFakeSSHRecorder()
+	recorder.fail["yum check-update"] = true
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if !provisioner.updatesPending() {
+			t.Fatal("expected updates pending when yum check-update reports non-zero")
+		}
+	})
+}
+
+func TestPackageInstalledSkipsReinstall(t *testing.T) {
+	recorder := newFakeSSHRecorder()
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if !provisioner.packageInstalled("docker-ce") {
+			t.Fatal("expected rpm -q success to report the package installed")
+		}
+	})
+}
+
+func TestPackageInstalledFalseWhenRpmQFails(t *testing.T) {
+	recorder := newFakeSSHRecorder()
+	recorder.fail["rpm -q"] = true
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if provisioner.packageInstalled("docker-ce") {
+			t.Fatal("expected rpm -q failure to report the package missing")
+		}
+	})
+}
+
+func TestFirewalldRulesCurrentWhenContentMatches(t *testing.T) {
+	desiredXML := "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<service>\n  <short>Docker Daemon</short>\n  <port protocol=\"tcp\" port=\"2376\"/>\n</service>\n"
+
+	recorder := newFakeSSHRecorder()
+	recorder.responses["cat /etc/firewalld/services/docker.xml"] = desiredXML
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if !provisioner.firewalldRulesCurrent(desiredXML) {
+			t.Fatal("expected matching firewalld rules to be reported as current")
+		}
+	})
+}
+
+func TestDockerOptionsCurrentWhenContentMatches(t *testing.T) {
+	desired := "OPTIONS='-H tcp://0.0.0.0:2376'\n"
+
+	recorder := newFakeSSHRecorder()
+	recorder.responses["cat /etc/sysconfig/docker"] = desired
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if !provisioner.dockerOptionsCurrent("/etc/sysconfig/docker", desired) {
+			t.Fatal("expected matching docker options to be reported as current")
+		}
+	})
+}
+
+func TestDockerOptionsNotCurrentWhenContentDiffers(t *testing.T) {
+	recorder := newFakeSSHRecorder()
+	recorder.responses["cat /etc/sysconfig/docker"] = "OPTIONS=''\n"
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if provisioner.dockerOptionsCurrent("/etc/sysconfig/docker", "OPTIONS='-H tcp://0.0.0.0:2376'\n") {
+			t.Fatal("expected differing docker options to be reported as stale")
+		}
+	})
+}
+
+func TestFirewalldRulesNotCurrentWhenContentDiffers(t *testing.T) {
+	desiredXML := "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<service>\n  <short>Docker Daemon</short>\n  <port protocol=\"tcp\" port=\"2376\"/>\n</service>\n"
+
+	recorder := newFakeSSHRecorder()
+	recorder.responses["cat /etc/firewalld/services/docker.xml"] = "<service/>"
+	provisioner := &CentosProvisioner{}
+
+	withFakeSSH(t, recorder, func() {
+		if provisioner.firewalldRulesCurrent(desiredXML) {
+			t.Fatal("expected differing firewalld rules to be reported as stale")
+		}
+	})
+}
+
+// TestProvisionIdempotentlySkipsMutatingCommandsOnRerun exercises
+// provisionIdempotently - the subset of Provision that reads back remote
+// state before mutating it - twice against a recorder that reports "already
+// up to date" for every check, and asserts it never issues the yum update,
+// package install or firewalld rewrite commands. The rest of Provision
+// (installDockerGeneric, makeDockerOptionsDir, ConfigureAuth,
+// configureSwarm, ...) calls package helpers defined outside this file and
+// needs a real drivers.Driver to exercise meaningfully, so it isn't covered here.
+func TestProvisionIdempotentlySkipsMutatingCommandsOnRerun(t *testing.T) {
+	desiredXML := "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<service>\n  <short>Docker Daemon</short>\n  <port protocol=\"tcp\" port=\"2376\"/>\n</service>\n"
+
+	recorder := newFakeSSHRecorder()
+	recorder.responses["cat /etc/firewalld/services/docker.xml"] = desiredXML
+	provisioner := &CentosProvisioner{packages: []string{"docker-ce"}}
+
+	withFakeSSH(t, recorder, func() {
+		for i := 0; i < 2; i++ {
+			if err := provisioner.provisionIdempotently(); err != nil {
+				t.Fatalf("run %d: provisionIdempotently returned %s", i, err)
+			}
+		}
+
+		if n := recorder.countContaining("yum -y update"); n != 0 {
+			t.Fatalf("expected no yum update across two runs, got %d", n)
+		}
+		if n := recorder.countContaining("yum -y install"); n != 0 {
+			t.Fatalf("expected no package install across two runs, got %d", n)
+		}
+		if n := recorder.countContaining("> /etc/firewalld/services/docker.xml"); n != 0 {
+			t.Fatalf("expected no firewalld rewrite across two runs, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package retry
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/log"
+)
+
+// transientSignatures are substrings of error/output text that indicate a
+// provisioning step failed for a reason that's likely to clear up on its
+// own (a mirror hiccup, a service not fully up yet) rather than a real bug.
+var transientSignatures = []string{
+	"Could not retrieve mirrorlist",
+	"Failed to download metadata",
+	"Connection refused",
+}
+
+// Retry calls op up to attempts times, backing off (doubling, with jitter)
+// between tries. It gives up immediately, without retrying, on errors that
+// don't match a known transient signature, so real bugs still surface fast.
+func Retry(op func() error, attempts int, backoff time.Duration) error {
+	var err error
+
+	for i := 0; i < attempts; i++ {
+		if err = op(); err == nil {
+			return nil
+		}
+
+		if !isTransient(err) {
+			return err
+		}
+
+		if i == attempts-1 {
+			break
+		}
+
+		sleep := backoff + time.Duration(rand.Int63n(int64(backoff)+1))
+		log.Debug("transient error, retrying in %s: %s", sleep, err)
+		time.Sleep(sleep)
+		backoff *= 2
+	}
+
+	return err
+}
+
+func isTransient(err error) bool {
+	msg := err.Error()
+	for _, sig := range transientSignatures {
+		if strings.Contains(msg, sig) {
+			return true
+		}
+	}
+
+	return false
+}